@@ -1,15 +1,174 @@
 package httputil
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/github/git-lfs/config"
 	"github.com/rubyist/tracerx"
 )
 
+// tlsConfigCache memoises the assembled *tls.Config for each host (RootCAs,
+// client cert pair, pinned fingerprints and InsecureSkipVerify) so that
+// batch operations like "git lfs fetch" against many objects don't re-read
+// and re-parse the same CA bundles and cert/key files on every request. Each
+// entry is invalidated by stat'ing its source files for mtime changes, so a
+// cache hit costs one stat per source file rather than a full read+parse.
+var (
+	tlsConfigCacheMu sync.Mutex
+	tlsConfigCache   = make(map[string]*tlsConfigCacheEntry)
+)
+
+type tlsConfigCacheEntry struct {
+	config      *tls.Config
+	endpoint    string
+	sourceMtime map[string]time.Time
+}
+
+// GetTLSConfigForHost returns the fully assembled TLS client configuration
+// to use when talking to host (which may be "host:port", as passed to
+// RootCAs/client-cert/sslverify settings), reusing a cached copy as long as
+// none of its source files have changed on disk since it was built.
+// endpoint is the LFS remote's full URL as it appears in lfs.<url>.* config
+// keys (eg. "https://git-server.com/repo.git/info/lfs"); it is distinct from
+// host because those keys are scoped by the whole endpoint URL, not just the
+// host part that http.* settings use.
+func GetTLSConfigForHost(cfg *config.Configuration, endpoint, host string) *tls.Config {
+	sources := tlsSourceFilesForHost(cfg, endpoint, host)
+
+	tlsConfigCacheMu.Lock()
+	entry, ok := tlsConfigCache[host]
+	tlsConfigCacheMu.Unlock()
+
+	if ok && entry.endpoint == endpoint && tlsSourceFilesUnchanged(entry.sourceMtime, sources) {
+		return entry.config
+	}
+
+	tlsConfig := buildTLSConfigForHost(cfg, endpoint, host)
+
+	tlsConfigCacheMu.Lock()
+	tlsConfigCache[host] = &tlsConfigCacheEntry{
+		config:      tlsConfig,
+		endpoint:    endpoint,
+		sourceMtime: statSourceFiles(sources),
+	}
+	tlsConfigCacheMu.Unlock()
+
+	return tlsConfig
+}
+
+// InvalidateTLSCache discards the cached TLS configuration for host, forcing
+// the next GetTLSConfigForHost call to rebuild it from disk. Callers that
+// know a cert, key or CA file has been rotated out-of-band (eg. a config
+// reload) should call this so the new files take effect immediately rather
+// than waiting for the next mtime check to notice the change.
+func InvalidateTLSCache(host string) {
+	tlsConfigCacheMu.Lock()
+	delete(tlsConfigCache, host)
+	tlsConfigCacheMu.Unlock()
+}
+
+func buildTLSConfigForHost(cfg *config.Configuration, endpoint, host string) *tls.Config {
+	tlsConfig := &tls.Config{
+		RootCAs:            getRootCAsForHost(cfg, host),
+		Certificates:       getClientCertForHost(cfg, host),
+		InsecureSkipVerify: isCertVerificationDisabledForHost(cfg, host),
+	}
+
+	if verifier := getSpiffeVerifierForHost(cfg, endpoint); verifier != nil {
+		// SPIFFE verification replaces the default chain verification
+		// against RootCAs with its own check against the trust-domain
+		// bundle, so the stdlib's verification must be disabled.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verifier
+	} else if verifier := getPinnedCertVerifier(cfg, host); verifier != nil {
+		tlsConfig.VerifyPeerCertificate = verifier
+	}
+
+	return tlsConfig
+}
+
+// tlsSourceFilesForHost returns the set of on-disk files that feed into the
+// TLS config for host/endpoint (CA file/dir, client cert, client key, SPIFFE
+// bundle), so their mtimes can be checked to decide whether a cached config
+// is still fresh.
+func tlsSourceFilesForHost(cfg *config.Configuration, endpoint, host string) []string {
+	var sources []string
+	if cafile, cadir := caFileOrDirForHost(cfg, host); len(cafile) > 0 {
+		sources = append(sources, cafile)
+	} else if len(cadir) > 0 {
+		sources = append(sources, filesInDir(cadir)...)
+	}
+	if cert := clientCertFileForHost(cfg, host); len(cert) > 0 {
+		sources = append(sources, cert)
+	}
+	if key := clientKeyFileForHost(cfg, host); len(key) > 0 {
+		sources = append(sources, key)
+	}
+	if bundle, ok := cfg.Git.Get(fmt.Sprintf("lfs.%v.spiffeBundle", endpoint)); ok && len(bundle) > 0 {
+		sources = append(sources, bundle)
+	}
+	return sources
+}
+
+// filesInDir returns the paths of the files directly inside dir, in the same
+// enumeration order appendCertsFromFilesInDir reads them in, so that each
+// file's own mtime (not just the directory's, which doesn't change when an
+// existing file's content is replaced in place) feeds the TLS config cache's
+// freshness check.
+func filesInDir(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		tracerx.Printf("Error reading cert dir %q: %v", dir, err)
+		return nil
+	}
+	paths := make([]string, 0, len(entries))
+	for _, f := range entries {
+		paths = append(paths, filepath.Join(dir, f.Name()))
+	}
+	return paths
+}
+
+func statSourceFiles(paths []string) map[string]time.Time {
+	mtimes := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			mtimes[path] = info.ModTime()
+		}
+	}
+	return mtimes
+}
+
+func tlsSourceFilesUnchanged(cached map[string]time.Time, current []string) bool {
+	seen := make(map[string]bool, len(current))
+	for _, path := range current {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false
+		}
+		cachedMtime, ok := cached[path]
+		if !ok || !info.ModTime().Equal(cachedMtime) {
+			return false
+		}
+		seen[path] = true
+	}
+	return len(seen) == len(cached)
+}
+
 // isCertVerificationDisabledForHost returns whether SSL certificate verification
 // has been disabled for the given host, or globally
 func isCertVerificationDisabledForHost(cfg *config.Configuration, host string) bool {
@@ -45,37 +204,53 @@ func getRootCAsForHost(cfg *config.Configuration, host string) *x509.CertPool {
 }
 
 func appendRootCAsForHostFromGitconfig(cfg *config.Configuration, pool *x509.CertPool, host string) *x509.CertPool {
-	// Accumulate certs from all these locations:
+	cafile, cadir := caFileOrDirForHost(cfg, host)
+	if len(cafile) > 0 {
+		return appendCertsFromFile(pool, cafile)
+	}
+	if len(cadir) > 0 {
+		return appendCertsFromFilesInDir(pool, cadir)
+	}
+
+	return pool
+
+}
 
+// caFileOrDirForHost resolves the CA file or directory configured for host
+// (which may be "host:port"), without reading it, checking in order
+// GIT_SSL_CAINFO, http.<url>.sslcainfo, http.sslcainfo, GIT_SSL_CAPATH,
+// http.sslcapath and returning the first one set. At most one of the two
+// return values is non-empty, and appendRootCAsForHostFromGitconfig loads
+// certs from that one source only.
+func caFileOrDirForHost(cfg *config.Configuration, host string) (cafile, cadir string) {
 	// GIT_SSL_CAINFO first
-	if cafile, _ := cfg.Os.Get("GIT_SSL_CAINFO"); len(cafile) > 0 {
-		return appendCertsFromFile(pool, cafile)
+	if cafile, _ = cfg.Os.Get("GIT_SSL_CAINFO"); len(cafile) > 0 {
+		return cafile, ""
 	}
 	// http.<url>/.sslcainfo or http.<url>.sslcainfo
 	// we know we have simply "host" or "host:port"
 	hostKeyWithSlash := fmt.Sprintf("http.https://%v/.sslcainfo", host)
 	if cafile, ok := cfg.Git.Get(hostKeyWithSlash); ok {
-		return appendCertsFromFile(pool, cafile)
+		return cafile, ""
 	}
 	hostKeyWithoutSlash := fmt.Sprintf("http.https://%v.sslcainfo", host)
 	if cafile, ok := cfg.Git.Get(hostKeyWithoutSlash); ok {
-		return appendCertsFromFile(pool, cafile)
+		return cafile, ""
 	}
 	// http.sslcainfo
 	if cafile, ok := cfg.Git.Get("http.sslcainfo"); ok {
-		return appendCertsFromFile(pool, cafile)
+		return cafile, ""
 	}
 	// GIT_SSL_CAPATH
-	if cadir, _ := cfg.Os.Get("GIT_SSL_CAPATH"); len(cadir) > 0 {
-		return appendCertsFromFilesInDir(pool, cadir)
+	if cadir, _ = cfg.Os.Get("GIT_SSL_CAPATH"); len(cadir) > 0 {
+		return "", cadir
 	}
 	// http.sslcapath
 	if cadir, ok := cfg.Git.Get("http.sslcapath"); ok {
-		return appendCertsFromFilesInDir(pool, cadir)
+		return "", cadir
 	}
 
-	return pool
-
+	return "", ""
 }
 
 func appendCertsFromFilesInDir(pool *x509.CertPool, dir string) *x509.CertPool {
@@ -120,6 +295,435 @@ func appendCerts(pool *x509.CertPool, certs []*x509.Certificate) *x509.CertPool
 
 	return pool
 }
+
+// getClientCertForHost returns the client certificate(s) to present for mTLS
+// to the given host (which may be "host:port"), configured via the same
+// http.sslCert / http.sslKey gitconfig keys (and GIT_SSL_CERT / GIT_SSL_KEY
+// environment variables) that git itself honours, using the same
+// host-then-global precedence as getRootCAsForHost. Returns nil if no client
+// certificate is configured for this host. Callers wanting this memoised
+// across calls should go through GetTLSConfigForHost instead.
+func getClientCertForHost(cfg *config.Configuration, host string) []tls.Certificate {
+	certFile := clientCertFileForHost(cfg, host)
+	if len(certFile) == 0 {
+		// Nothing configured for this host, no client cert to present
+		return nil
+	}
+	keyFile := clientKeyFileForHost(cfg, host)
+	if len(keyFile) == 0 {
+		// git allows sslCert to contain both the cert and the key
+		keyFile = certFile
+	}
+
+	return loadClientCertForHost(cfg, host, certFile, keyFile)
+}
+
+// clientCertFileForHost resolves the client certificate file configured for
+// host from GIT_SSL_CERT or http.sslCert (host-scoped, then global), without
+// reading it.
+func clientCertFileForHost(cfg *config.Configuration, host string) string {
+	if certFile, _ := cfg.Os.Get("GIT_SSL_CERT"); len(certFile) > 0 {
+		return certFile
+	}
+	if certFile, ok := cfg.Git.Get(fmt.Sprintf("http.https://%v/.sslcert", host)); ok {
+		return certFile
+	}
+	if certFile, ok := cfg.Git.Get(fmt.Sprintf("http.https://%v.sslcert", host)); ok {
+		return certFile
+	}
+	certFile, _ := cfg.Git.Get("http.sslcert")
+	return certFile
+}
+
+// clientKeyFileForHost resolves the client private key file configured for
+// host from GIT_SSL_KEY or http.sslKey (host-scoped, then global), without
+// reading it.
+func clientKeyFileForHost(cfg *config.Configuration, host string) string {
+	if keyFile, _ := cfg.Os.Get("GIT_SSL_KEY"); len(keyFile) > 0 {
+		return keyFile
+	}
+	if keyFile, ok := cfg.Git.Get(fmt.Sprintf("http.https://%v/.sslkey", host)); ok {
+		return keyFile
+	}
+	if keyFile, ok := cfg.Git.Get(fmt.Sprintf("http.https://%v.sslkey", host)); ok {
+		return keyFile
+	}
+	keyFile, _ := cfg.Git.Get("http.sslkey")
+	return keyFile
+}
+
+func loadClientCertForHost(cfg *config.Configuration, host, certFile, keyFile string) []tls.Certificate {
+	passwordProtected := isCertPasswordProtectedForHost(cfg, host)
+	if !passwordProtected {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			tracerx.Printf("Error loading client cert/key for %q: %v", host, err)
+			return nil
+		}
+		return []tls.Certificate{cert}
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		tracerx.Printf("Error reading client cert %q: %v", certFile, err)
+		return nil
+	}
+	keyPEM, err := decryptPasswordProtectedKey(keyFile, host)
+	if err != nil {
+		tracerx.Printf("Error reading client key %q: %v", keyFile, err)
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		tracerx.Printf("Error parsing client cert/key for %q: %v", host, err)
+		return nil
+	}
+	return []tls.Certificate{cert}
+}
+
+// isCertPasswordProtectedForHost returns whether the client cert's private
+// key for the given host is encrypted with a passphrase, per
+// http.sslCertPasswordProtected (host-scoped, then global).
+func isCertPasswordProtectedForHost(cfg *config.Configuration, host string) bool {
+	hostProtected, _ := cfg.Git.Get(fmt.Sprintf("http.https://%v/.sslCertPasswordProtected", host))
+	if hostProtected == "true" {
+		return true
+	}
+
+	globalProtected, _ := cfg.Git.Get("http.sslCertPasswordProtected")
+	return globalProtected == "true"
+}
+
+// decryptPasswordProtectedKey reads an encrypted PEM-encoded private key and
+// decrypts it, prompting for the passphrase through the credential helper
+// used elsewhere for this host if it is not already cached.
+//
+// Decryption is shelled out to "openssl pkey" rather than done with the
+// standard library's x509.DecryptPEMBlock, which the stdlib itself
+// documents as insecure (no integrity check over the ciphertext, vulnerable
+// to padding-oracle attacks) and "should not be used for new applications".
+// The passphrase is piped over stdin, never passed as an argument, so it
+// doesn't show up in the process list.
+func decryptPasswordProtectedKey(keyFile, host string) ([]byte, error) {
+	passphrase, err := getCertPassphrase(host)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("openssl", "pkey", "-in", keyFile, "-passin", "stdin")
+	cmd.Stdin = strings.NewReader(passphrase + "\n")
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt %q: %v", keyFile, err)
+	}
+
+	if block, _ := pem.Decode(out); block == nil {
+		return nil, fmt.Errorf("openssl did not return a decrypted PEM key for %q", keyFile)
+	}
+
+	return out, nil
+}
+
+// getCertPassphrase obtains the passphrase for a password-protected client
+// certificate key by running it through "git credential fill", the same
+// helper protocol git-lfs relies on for HTTP basic auth, using a synthetic
+// "cert" protocol so a configured helper can supply a passphrase it already
+// holds before falling back to a prompt. The passphrase is not passed back
+// through "git credential approve", so this function never asks a helper to
+// store it.
+func getCertPassphrase(host string) (string, error) {
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=cert\nhost=%v\n\n", host))
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not obtain passphrase for %q: %v", host, err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "password=") {
+			return strings.TrimPrefix(line, "password="), nil
+		}
+	}
+
+	return "", fmt.Errorf("no passphrase returned by credential helper for %q", host)
+}
+
+// getPinnedFingerprintsForHost returns the configured SHA-256 certificate
+// fingerprints to pin for the given host (which may be "host:port"), read
+// from http.https://host/.sslPinnedFingerprint with a fallback to the global
+// http.sslPinnedFingerprint, using the same host-then-global precedence as
+// isCertVerificationDisabledForHost and getRootCAsForHost. Multiple pins may
+// be given as a comma-separated list; returns nil if none are configured.
+func getPinnedFingerprintsForHost(cfg *config.Configuration, host string) []string {
+	value, ok := cfg.Git.Get(fmt.Sprintf("http.https://%v/.sslPinnedFingerprint", host))
+	if !ok {
+		value, ok = cfg.Git.Get("http.sslPinnedFingerprint")
+	}
+	if !ok || len(value) == 0 {
+		return nil
+	}
+
+	var fingerprints []string
+	for _, pin := range strings.Split(value, ",") {
+		if pin = strings.TrimSpace(pin); len(pin) > 0 {
+			fingerprints = append(fingerprints, pin)
+		}
+	}
+	return fingerprints
+}
+
+// verifyPinnedCertificate reports whether any certificate in rawCerts (the
+// raw ASN.1 DER presented by tls.Config.VerifyPeerCertificate) matches one of
+// the given SHA-256 fingerprints. Fingerprints may be given in "sha256/"
+// base64 form (as used by HPKP) or plain hex.
+func verifyPinnedCertificate(rawCerts [][]byte, fingerprints []string) error {
+	for _, raw := range rawCerts {
+		sum := sha256.Sum256(raw)
+		for _, fingerprint := range fingerprints {
+			want, err := decodeFingerprint(fingerprint)
+			if err != nil {
+				tracerx.Printf("Ignoring malformed sslPinnedFingerprint %q: %v", fingerprint, err)
+				continue
+			}
+			if len(want) == len(sum) && subtle.ConstantTimeCompare(sum[:], want) == 1 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("none of the presented certificates matched the configured sslPinnedFingerprint")
+}
+
+func decodeFingerprint(fingerprint string) ([]byte, error) {
+	// "sha256/" unambiguously marks base64 (as used by HPKP); a bare hex
+	// fingerprint is also valid base64 alphabet, so without the prefix we
+	// must try hex first or a hex pin silently decodes as the wrong bytes.
+	if base64Fingerprint := strings.TrimPrefix(fingerprint, "sha256/"); base64Fingerprint != fingerprint {
+		return base64.StdEncoding.DecodeString(base64Fingerprint)
+	}
+	if decoded, err := hex.DecodeString(strings.Replace(fingerprint, ":", "", -1)); err == nil {
+		return decoded, nil
+	}
+	return base64.StdEncoding.DecodeString(fingerprint)
+}
+
+// getPinnedCertVerifier returns a tls.Config.VerifyPeerCertificate callback
+// that enforces the sslPinnedFingerprint(s) configured for host, or nil if
+// none are configured. Chain verification by the standard library happens
+// independently of this callback (governed by tls.Config.InsecureSkipVerify,
+// which isCertVerificationDisabledForHost already controls), so when pinning
+// is configured alongside disabled CA verification this callback becomes the
+// only check of the server's identity. buildTLSConfigForHost is what
+// installs this callback onto a tls.Config's VerifyPeerCertificate field.
+func getPinnedCertVerifier(cfg *config.Configuration, host string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	fingerprints := getPinnedFingerprintsForHost(cfg, host)
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyPinnedCertificate(rawCerts, fingerprints)
+	}
+}
+
+// spiffeBundleCache memoises one parsed trust bundle per trust domain,
+// together with the bundle file path it was read from (a different path for
+// the same trust domain replaces the entry), since a SPIFFE/SPIRE-issued bundle is shared
+// across every host that trusts the same trust domain. Entries are
+// invalidated by mtime, the same way tlsConfigCache is, so a bundle rotated
+// on disk by SPIRE is picked up without a process restart.
+var (
+	spiffeBundleCacheMu sync.Mutex
+	spiffeBundleCache   = make(map[string]*spiffeBundleCacheEntry)
+)
+
+type spiffeBundleCacheEntry struct {
+	pool   *x509.CertPool
+	mtime  time.Time
+	bundle string
+}
+
+// getSpiffeVerifierForHost returns a tls.Config.VerifyPeerCertificate
+// callback that authenticates the LFS server at endpoint (its full remote
+// URL, eg. "https://git-server.com/repo.git/info/lfs" — the same value
+// other lfs.<url>.* config keys are scoped by, which is NOT the same string
+// as the host/host:port that http.* settings elsewhere in this file use) by
+// its SPIFFE ID, or nil if lfs.<url>.spiffeID is not configured for it.
+// Configuring this also requires lfs.<url>.spiffeBundle, a path to the trust
+// bundle (PEM or JWKS JSON) for the ID's trust domain.
+func getSpiffeVerifierForHost(cfg *config.Configuration, endpoint string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	spiffeID, ok := cfg.Git.Get(fmt.Sprintf("lfs.%v.spiffeID", endpoint))
+	if !ok || len(spiffeID) == 0 {
+		return nil
+	}
+
+	bundleFile, ok := cfg.Git.Get(fmt.Sprintf("lfs.%v.spiffeBundle", endpoint))
+	if !ok || len(bundleFile) == 0 {
+		tracerx.Printf("lfs.%v.spiffeID is set without lfs.%v.spiffeBundle, ignoring", endpoint, endpoint)
+		return nil
+	}
+
+	trustDomain, err := spiffeTrustDomain(spiffeID)
+	if err != nil {
+		tracerx.Printf("Invalid lfs.%v.spiffeID %q: %v", endpoint, spiffeID, err)
+		return nil
+	}
+
+	// Fail closed: once a valid lfs.<url>.spiffeID and an
+	// lfs.<url>.spiffeBundle are both configured, a server must
+	// authenticate by SPIFFE ID or not at all. If the bundle can't be
+	// loaded, reject every connection rather than silently falling back
+	// to pinned-fingerprint or default RootCAs verification. (A missing
+	// spiffeBundle or a malformed spiffeID, handled above, installs no
+	// SPIFFE verifier at all.)
+	pool, err := trustPoolForSpiffeBundle(trustDomain, bundleFile)
+	if err != nil {
+		tracerx.Printf("Error loading SPIFFE trust bundle %q for %q: %v", bundleFile, trustDomain, err)
+		return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return fmt.Errorf("could not load SPIFFE trust bundle %q for %q: %v", bundleFile, trustDomain, err)
+		}
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifySpiffeChain(rawCerts, pool, spiffeID)
+	}
+}
+
+// spiffeTrustDomain extracts the trust domain ("example.org") from a SPIFFE
+// ID of the form "spiffe://example.org/lfs".
+func spiffeTrustDomain(spiffeID string) (string, error) {
+	const scheme = "spiffe://"
+	if !strings.HasPrefix(spiffeID, scheme) {
+		return "", fmt.Errorf("missing %q scheme", scheme)
+	}
+
+	rest := strings.TrimPrefix(spiffeID, scheme)
+	if idx := strings.Index(rest, "/"); idx >= 0 {
+		return rest[:idx], nil
+	}
+	return rest, nil
+}
+
+// trustPoolForSpiffeBundle returns the cached *x509.CertPool for
+// trustDomain, reloading it from bundleFile whenever that file's mtime has
+// changed since it was last parsed (or it hasn't been loaded yet).
+func trustPoolForSpiffeBundle(trustDomain, bundleFile string) (*x509.CertPool, error) {
+	info, err := os.Stat(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	spiffeBundleCacheMu.Lock()
+	entry, ok := spiffeBundleCache[trustDomain]
+	spiffeBundleCacheMu.Unlock()
+
+	if ok && entry.bundle == bundleFile && entry.mtime.Equal(info.ModTime()) {
+		return entry.pool, nil
+	}
+
+	pool, err := loadSpiffeBundle(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	spiffeBundleCacheMu.Lock()
+	spiffeBundleCache[trustDomain] = &spiffeBundleCacheEntry{pool: pool, mtime: info.ModTime(), bundle: bundleFile}
+	spiffeBundleCacheMu.Unlock()
+
+	return pool, nil
+}
+
+// loadSpiffeBundle reads a SPIFFE trust bundle, trying the JWKS JSON format
+// first and falling back to plain PEM.
+func loadSpiffeBundle(bundleFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if pool, err := spiffeBundleFromJWKS(data); err == nil {
+		return pool, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %q", bundleFile)
+	}
+	return pool, nil
+}
+
+// spiffeBundleFromJWKS parses the SPIFFE JWKS bundle format: a JSON document
+// with a "keys" array, each entry carrying its certificate chain as base64
+// DER in "x5c".
+func spiffeBundleFromJWKS(data []byte) (*x509.CertPool, error) {
+	var jwks struct {
+		Keys []struct {
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, fmt.Errorf("no keys in JWKS bundle")
+	}
+
+	pool := x509.NewCertPool()
+	var found bool
+	for _, key := range jwks.Keys {
+		for _, encoded := range key.X5c {
+			der, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				continue
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				continue
+			}
+			pool.AddCert(cert)
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no valid certificates in JWKS bundle")
+	}
+	return pool, nil
+}
+
+// verifySpiffeChain verifies the presented chain against the trust-domain
+// pool and requires the leaf certificate's URI SAN to exactly match
+// spiffeID.
+func verifySpiffeChain(rawCerts [][]byte, pool *x509.CertPool, spiffeID string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("could not parse server certificate: %v", err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, raw := range rawCerts[1:] {
+		if cert, err := x509.ParseCertificate(raw); err == nil {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("certificate does not chain to the SPIFFE trust bundle: %v", err)
+	}
+
+	for _, uri := range leaf.URIs {
+		if uri.String() == spiffeID {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate URI SAN does not match configured spiffeID %q", spiffeID)
+}
+
 func appendCertsFromPEMData(pool *x509.CertPool, data []byte) *x509.CertPool {
 	if len(data) == 0 {
 		return pool
@@ -0,0 +1,542 @@
+package httputil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/github/git-lfs/config"
+)
+
+func sha256SumHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fakeGitEnv and fakeOsEnv back a config.Configuration with plain maps so
+// tests can exercise the host/global gitconfig precedence used throughout
+// this file without touching real gitconfig or the filesystem.
+type fakeGitEnv map[string]string
+
+func (f fakeGitEnv) Get(key string) (string, bool) {
+	v, ok := f[key]
+	return v, ok
+}
+
+type fakeOsEnv map[string]string
+
+func (f fakeOsEnv) Get(key string) (string, bool) {
+	v, ok := f[key]
+	return v, ok
+}
+
+func (f fakeOsEnv) Bool(key string, def bool) bool {
+	v, ok := f[key]
+	if !ok {
+		return def
+	}
+	return v == "true"
+}
+
+func fakeConfig(git, os fakeGitEnv) *config.Configuration {
+	return &config.Configuration{Git: git, Os: fakeOsEnv(os)}
+}
+
+func TestDecodeFingerprintHex(t *testing.T) {
+	got, err := decodeFingerprint("AA:BB:cc:dd")
+	if err != nil {
+		t.Fatalf("decodeFingerprint: %v", err)
+	}
+	want := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	if string(got) != string(want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestDecodeFingerprintBase64(t *testing.T) {
+	// base64 of the bytes {0xaa, 0xbb, 0xcc, 0xdd}
+	got, err := decodeFingerprint("sha256/qrvM3Q==")
+	if err != nil {
+		t.Fatalf("decodeFingerprint: %v", err)
+	}
+	want := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	if string(got) != string(want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+func TestVerifyPinnedCertificateMatch(t *testing.T) {
+	raw := []byte("pretend-der-bytes")
+	sum := sha256SumHex(raw)
+
+	err := verifyPinnedCertificate([][]byte{raw}, []string{sum})
+	if err != nil {
+		t.Fatalf("expected matching fingerprint to verify, got: %v", err)
+	}
+}
+
+func TestVerifyPinnedCertificateMismatch(t *testing.T) {
+	raw := []byte("pretend-der-bytes")
+
+	err := verifyPinnedCertificate([][]byte{raw}, []string{"00112233445566778899aabbccddeeff00112233445566778899aabbccddee"})
+	if err == nil {
+		t.Fatal("expected non-matching fingerprint to fail verification")
+	}
+}
+
+func TestGetPinnedFingerprintsForHostPrefersHostOverGlobal(t *testing.T) {
+	cfg := fakeConfig(fakeGitEnv{
+		"http.https://example.com/.sslPinnedFingerprint": "aabb, ccdd",
+		"http.sslPinnedFingerprint":                      "eeff",
+	}, nil)
+
+	got := getPinnedFingerprintsForHost(cfg, "example.com")
+	if len(got) != 2 || got[0] != "aabb" || got[1] != "ccdd" {
+		t.Fatalf("got %v, want [aabb ccdd]", got)
+	}
+}
+
+func TestGetPinnedCertVerifierWiredIntoTLSConfig(t *testing.T) {
+	cfg := fakeConfig(fakeGitEnv{
+		"http.sslPinnedFingerprint": sha256SumHex([]byte("pretend-der-bytes")),
+	}, nil)
+
+	tlsConfig := buildTLSConfigForHost(cfg, "https://example.com/lfs", "example.com")
+	if tlsConfig.VerifyPeerCertificate == nil {
+		t.Fatal("expected pinned fingerprint to install a VerifyPeerCertificate callback")
+	}
+	if err := tlsConfig.VerifyPeerCertificate([][]byte{[]byte("pretend-der-bytes")}, nil); err != nil {
+		t.Fatalf("expected matching cert to pass the installed callback, got: %v", err)
+	}
+	if err := tlsConfig.VerifyPeerCertificate([][]byte{[]byte("some-other-cert")}, nil); err == nil {
+		t.Fatal("expected non-matching cert to fail the installed callback")
+	}
+}
+
+// generateTestClientCertPEM returns a self-signed certificate and its
+// matching private key, both PEM-encoded, suitable for exercising the
+// client-cert loading path without touching a real mTLS deployment.
+func generateTestClientCertPEM(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "git-lfs test client cert"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM
+}
+
+func TestGetClientCertForHostWiredIntoTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	certPEM, keyPEM := generateTestClientCertPEM(t)
+	writeTestFile(t, certFile, certPEM)
+	writeTestFile(t, keyFile, keyPEM)
+
+	cfg := fakeConfig(fakeGitEnv{
+		"http.sslcert": certFile,
+		"http.sslkey":  keyFile,
+	}, nil)
+
+	tlsConfig := buildTLSConfigForHost(cfg, "https://example.com/lfs", "example.com")
+	if len(tlsConfig.Certificates) != 1 {
+		t.Fatalf("expected the configured client cert to be loaded into tls.Config.Certificates, got %d entries", len(tlsConfig.Certificates))
+	}
+}
+
+func TestCaFileOrDirForHostPrecedence(t *testing.T) {
+	cfg := fakeConfig(fakeGitEnv{
+		"http.https://example.com/.sslcainfo": "/host-scoped",
+		"http.sslcainfo":                      "/global",
+	}, fakeGitEnv{"GIT_SSL_CAINFO": "/env"})
+
+	if cafile, _ := caFileOrDirForHost(cfg, "example.com"); cafile != "/env" {
+		t.Fatalf("GIT_SSL_CAINFO should win, got %q", cafile)
+	}
+
+	cfg = fakeConfig(fakeGitEnv{
+		"http.https://example.com/.sslcainfo": "/host-scoped",
+		"http.sslcainfo":                      "/global",
+	}, nil)
+	if cafile, _ := caFileOrDirForHost(cfg, "example.com"); cafile != "/host-scoped" {
+		t.Fatalf("host-scoped sslcainfo should win over global, got %q", cafile)
+	}
+
+	cfg = fakeConfig(fakeGitEnv{"http.sslcainfo": "/global"}, nil)
+	if cafile, _ := caFileOrDirForHost(cfg, "example.com"); cafile != "/global" {
+		t.Fatalf("global sslcainfo should be used as a last resort, got %q", cafile)
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("could not write %q: %v", path, err)
+	}
+}
+
+// generateTestCAPEM returns a self-signed CA certificate, PEM-encoded,
+// suitable for exercising the CA-loading and caching paths without touching
+// the real filesystem's trust store.
+func generateTestCAPEM(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "git-lfs test CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestGetTLSConfigForHostCachesUntilSourceFileChanges(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, caFile, generateTestCAPEM(t))
+
+	cfg := fakeConfig(fakeGitEnv{"http.sslcainfo": caFile}, nil)
+	host := "tls-cache-test-host"
+	defer InvalidateTLSCache(host)
+
+	first := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	second := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	if first != second {
+		t.Fatal("expected the cached *tls.Config to be reused when the CA file is unchanged")
+	}
+
+	// A different mtime, even with identical bytes, must be treated as a
+	// potential change and trigger a rebuild.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(caFile, future, future); err != nil {
+		t.Fatalf("could not touch %q: %v", caFile, err)
+	}
+
+	third := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	if third == second {
+		t.Fatal("expected the config to be rebuilt after the CA file's mtime changed")
+	}
+}
+
+func TestGetTLSConfigForHostCachesUntilCapathFileContentChanges(t *testing.T) {
+	dir := t.TempDir()
+	caDir := filepath.Join(dir, "ca.d")
+	if err := os.Mkdir(caDir, 0755); err != nil {
+		t.Fatalf("could not create %q: %v", caDir, err)
+	}
+	caFile := filepath.Join(caDir, "ca.pem")
+	writeTestFile(t, caFile, generateTestCAPEM(t))
+
+	cfg := fakeConfig(fakeGitEnv{"http.sslcapath": caDir}, nil)
+	host := "tls-cache-capath-test-host"
+	defer InvalidateTLSCache(host)
+
+	first := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	second := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	if first != second {
+		t.Fatal("expected the cached *tls.Config to be reused when the capath dir is unchanged")
+	}
+
+	// Replacing an existing file's content in place, with a fresh mtime,
+	// does not change the directory's own mtime - the cache must still
+	// notice via the file's mtime, not just the directory's.
+	future := time.Now().Add(time.Hour)
+	writeTestFile(t, caFile, generateTestCAPEM(t))
+	if err := os.Chtimes(caFile, future, future); err != nil {
+		t.Fatalf("could not touch %q: %v", caFile, err)
+	}
+
+	third := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	if third == second {
+		t.Fatal("expected the config to be rebuilt after a file inside the capath dir changed")
+	}
+}
+
+func TestInvalidateTLSCacheForcesRebuild(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, caFile, generateTestCAPEM(t))
+
+	cfg := fakeConfig(fakeGitEnv{"http.sslcainfo": caFile}, nil)
+	host := "tls-cache-invalidate-test-host"
+	defer InvalidateTLSCache(host)
+
+	first := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	InvalidateTLSCache(host)
+	second := GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	if first == second {
+		t.Fatal("expected InvalidateTLSCache to force a rebuild on the next call")
+	}
+}
+
+// BenchmarkGetRootCAsForHostUncached models the pre-cache behavior: every
+// simulated object transfer during a fetch re-reads and re-parses the CA
+// bundle from disk, as getRootCAsForHost did before GetTLSConfigForHost
+// memoised it.
+func BenchmarkGetRootCAsForHostUncached(b *testing.B) {
+	dir := b.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+
+	var bundle bytes.Buffer
+	cert := generateTestCAPEMForBenchmark(b)
+	for i := 0; i < 200; i++ {
+		bundle.Write(cert)
+	}
+	if err := ioutil.WriteFile(caFile, bundle.Bytes(), 0600); err != nil {
+		b.Fatalf("could not write %q: %v", caFile, err)
+	}
+
+	cfg := fakeConfig(fakeGitEnv{"http.sslcainfo": caFile}, nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getRootCAsForHost(cfg, "bench-host")
+	}
+}
+
+// BenchmarkGetTLSConfigForHostCached models the same hundreds-of-objects
+// fetch with the mtime-validated cache in place: only the first call parses
+// the bundle, every later one is a handful of stat(2) calls.
+func BenchmarkGetTLSConfigForHostCached(b *testing.B) {
+	dir := b.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+
+	var bundle bytes.Buffer
+	cert := generateTestCAPEMForBenchmark(b)
+	for i := 0; i < 200; i++ {
+		bundle.Write(cert)
+	}
+	if err := ioutil.WriteFile(caFile, bundle.Bytes(), 0600); err != nil {
+		b.Fatalf("could not write %q: %v", caFile, err)
+	}
+
+	cfg := fakeConfig(fakeGitEnv{"http.sslcainfo": caFile}, nil)
+	host := "bench-cached-host"
+	defer InvalidateTLSCache(host)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		GetTLSConfigForHost(cfg, "https://"+host+"/lfs", host)
+	}
+}
+
+func generateTestCAPEMForBenchmark(b *testing.B) []byte {
+	b.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatalf("could not generate key: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "git-lfs bench CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		b.Fatalf("could not create certificate: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// generateSpiffeTestChain returns a CA certificate and a leaf certificate it
+// signed, the leaf carrying spiffeID as its sole URI SAN, for exercising
+// verifySpiffeChain without a real SPIRE deployment.
+func generateSpiffeTestChain(t *testing.T, spiffeID string) (caDER, leafDER []byte) {
+	t.Helper()
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate CA key: %v", err)
+	}
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "spiffe test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err = x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("could not create CA certificate: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("could not parse CA certificate: %v", err)
+	}
+
+	uri, err := url.Parse(spiffeID)
+	if err != nil {
+		t.Fatalf("could not parse spiffeID %q: %v", spiffeID, err)
+	}
+
+	leafKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate leaf key: %v", err)
+	}
+	leafTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "spiffe test leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err = x509.CreateCertificate(rand.Reader, &leafTemplate, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("could not create leaf certificate: %v", err)
+	}
+
+	return caDER, leafDER
+}
+
+func TestSpiffeTrustDomain(t *testing.T) {
+	cases := []struct {
+		spiffeID string
+		want     string
+		wantErr  bool
+	}{
+		{"spiffe://example.org/lfs", "example.org", false},
+		{"spiffe://example.org", "example.org", false},
+		{"not-a-spiffe-id", "", true},
+	}
+	for _, c := range cases {
+		got, err := spiffeTrustDomain(c.spiffeID)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("spiffeTrustDomain(%q): expected error, got %q", c.spiffeID, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("spiffeTrustDomain(%q) = %q, %v; want %q, nil", c.spiffeID, got, err, c.want)
+		}
+	}
+}
+
+func TestVerifySpiffeChain(t *testing.T) {
+	spiffeID := "spiffe://example.org/lfs"
+	caDER, leafDER := generateSpiffeTestChain(t, spiffeID)
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("could not parse CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	if err := verifySpiffeChain([][]byte{leafDER}, pool, spiffeID); err != nil {
+		t.Fatalf("expected chain signed by the trust bundle with a matching SPIFFE ID to verify, got: %v", err)
+	}
+
+	if err := verifySpiffeChain([][]byte{leafDER}, pool, "spiffe://other.org/lfs"); err == nil {
+		t.Fatal("expected a non-matching SPIFFE ID to fail verification")
+	}
+
+	emptyPool := x509.NewCertPool()
+	if err := verifySpiffeChain([][]byte{leafDER}, emptyPool, spiffeID); err == nil {
+		t.Fatal("expected a chain that doesn't lead to the trust bundle to fail verification")
+	}
+}
+
+func TestSpiffeBundleFromJWKS(t *testing.T) {
+	caDER, _ := generateSpiffeTestChain(t, "spiffe://example.org/lfs")
+
+	jwks := fmt.Sprintf(`{"keys":[{"x5c":[%q]}]}`, base64.StdEncoding.EncodeToString(caDER))
+
+	pool, err := spiffeBundleFromJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatalf("spiffeBundleFromJWKS: %v", err)
+	}
+	if pool == nil {
+		t.Fatal("expected a non-nil pool from a valid JWKS bundle")
+	}
+
+	if _, err := spiffeBundleFromJWKS([]byte(`{"keys":[]}`)); err == nil {
+		t.Fatal("expected an empty JWKS bundle to be rejected")
+	}
+	if _, err := spiffeBundleFromJWKS([]byte(`not json`)); err == nil {
+		t.Fatal("expected non-JSON input to be rejected")
+	}
+}
+
+// TestGetSpiffeVerifierForHostUsesEndpointNotHost guards against the
+// lfs.<url>.spiffeID / lfs.<url>.spiffeBundle keys being looked up by the
+// bare host instead of the full LFS endpoint URL they're actually scoped by.
+func TestGetSpiffeVerifierForHostUsesEndpointNotHost(t *testing.T) {
+	spiffeID := "spiffe://example.org/lfs"
+	caDER, _ := generateSpiffeTestChain(t, spiffeID)
+
+	dir := t.TempDir()
+	bundleFile := filepath.Join(dir, "bundle.pem")
+	writeTestFile(t, bundleFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+
+	endpoint := "https://example.com/repo.git/info/lfs"
+	host := "example.com"
+
+	cfg := fakeConfig(fakeGitEnv{
+		fmt.Sprintf("lfs.%v.spiffeID", endpoint):     spiffeID,
+		fmt.Sprintf("lfs.%v.spiffeBundle", endpoint): bundleFile,
+	}, nil)
+
+	if verifier := getSpiffeVerifierForHost(cfg, endpoint); verifier == nil {
+		t.Fatal("expected a verifier to be installed when looked up by the configured endpoint URL")
+	}
+	if verifier := getSpiffeVerifierForHost(cfg, host); verifier != nil {
+		t.Fatal("spiffeID/spiffeBundle configured by endpoint URL must not resolve from the bare host")
+	}
+}